@@ -0,0 +1,177 @@
+package smtpd
+
+import "io"
+
+// Backend is an alternative to Handler for servers that need to stream
+// message data (e.g. to disk or to an upstream server) instead of buffering
+// the whole Envelope in memory, and that need per-command state transitions
+// so invalid commands can be rejected before DATA is even read.
+//
+// When Server.Backend is set, it takes precedence over Handler and
+// LMTPHandler; session.serve() calls NewSession once per connection and
+// drives the returned Session through the MAIL/RCPT/DATA commands.
+type Backend interface {
+	// NewSession is called once a client has completed the greeting
+	// (HELO/EHLO/LHLO), and returns a Session used for the rest of the
+	// connection.
+	NewSession(peer Peer) (Session, error)
+}
+
+// Session is the streaming counterpart of Envelope/Handler. Each method
+// corresponds to an SMTP command and may return an Error to report a
+// specific SMTP status code back to the client.
+type Session interface {
+	// Mail is called on MAIL FROM, with any ESMTP parameters parsed into opts.
+	// It starts a new mail transaction, so an implementation that
+	// accumulates recipients or data between Mail and Data must discard
+	// anything left over from a prior transaction on the same connection.
+	Mail(from string, opts MailOptions) error
+
+	// Rcpt is called once per RCPT TO.
+	Rcpt(to string) error
+
+	// Data is called once the client sends DATA, with r streaming the
+	// message body (already dot-unstuffed) up to Server.MaxMessageSize.
+	// Implementations that need to read it more than once should buffer it
+	// themselves.
+	Data(r io.Reader) error
+
+	// Reset is called on RSET, or before a MAIL FROM that restarts a
+	// transaction without QUIT.
+	Reset()
+
+	// Logout is called once, when the session ends (QUIT or the connection
+	// is closed), to release any resources acquired in NewSession.
+	Logout() error
+}
+
+// LMTPSession is implemented by a Session that wants to report one status
+// per recipient for the end-of-DATA response, as LMTP (RFC 2033) requires.
+// session.finishData checks for it, after a successful Data() call, when
+// Server.LMTP is set; a Session that doesn't implement it gets a single
+// reply line instead, same as plain SMTP.
+type LMTPSession interface {
+	Session
+
+	// RecipientStatus returns one error per recipient, in the order they
+	// were accepted by RCPT TO, for the message most recently passed to
+	// Data. A nil entry means that recipient's delivery succeeded.
+	RecipientStatus() []error
+}
+
+// MailOptions carries the ESMTP parameters that may follow MAIL FROM, as
+// registered extensions such as SIZE, BODY=8BITMIME/7BIT, SMTPUTF8, AUTH=,
+// RET= and ENVID= allow.
+type MailOptions struct {
+	// Size is the value of the SIZE parameter, in bytes, or 0 if absent.
+	Size int
+
+	// Body is the value of the BODY parameter ("7BIT" or "8BITMIME"), or
+	// empty if absent.
+	Body string
+
+	// UTF8 is true when the SMTPUTF8 parameter was present.
+	UTF8 bool
+
+	// Auth is the value of the AUTH parameter (RFC 4954 relaying identity),
+	// or empty if absent or sent as "<>".
+	Auth string
+
+	// Return is the value of the RET parameter ("FULL" or "HDRS"), used for
+	// DSN (RFC 3461), or empty if absent.
+	Return string
+
+	// EnvelopeID is the value of the ENVID parameter, used for DSN
+	// (RFC 3461), or empty if absent.
+	EnvelopeID string
+}
+
+// handlerBackend adapts the legacy Handler/LMTPHandler callbacks to the
+// Backend/Session interface, so existing embedders keep working unchanged
+// while session.serve() only has to know about Backend.
+type handlerBackend struct {
+	srv *Server
+}
+
+func (b *handlerBackend) NewSession(peer Peer) (Session, error) {
+	return &handlerSession{srv: b.srv, peer: peer}, nil
+}
+
+// handlerSession buffers MAIL/RCPT/DATA into an Envelope and delivers it
+// through Handler or LMTPHandler as soon as DATA completes, recording the
+// outcome so the end-of-DATA response can be built from it: a single reply
+// for Handler, or one reply per recipient (via RecipientStatus) for
+// LMTPHandler.
+type handlerSession struct {
+	srv      *Server
+	peer     Peer
+	envelope Envelope
+
+	// recipientStatus holds the result of the most recent LMTPHandler
+	// delivery, one entry per recipient in envelope.Recipients order.
+	recipientStatus []error
+}
+
+func (s *handlerSession) Mail(from string, opts MailOptions) error {
+	s.envelope = Envelope{Sender: from}
+	s.recipientStatus = nil
+	return nil
+}
+
+func (s *handlerSession) Rcpt(to string) error {
+	s.envelope.Recipients = append(s.envelope.Recipients, to)
+	return nil
+}
+
+func (s *handlerSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.envelope.Data = data
+
+	if s.srv.LMTP {
+		s.recipientStatus = s.lmtpDeliver()
+		for _, rcptErr := range s.recipientStatus {
+			if rcptErr != nil {
+				return rcptErr
+			}
+		}
+		return nil
+	}
+
+	if s.srv.Handler != nil {
+		return s.srv.Handler(s.peer, s.envelope)
+	}
+	return nil
+}
+
+// RecipientStatus implements LMTPSession.
+func (s *handlerSession) RecipientStatus() []error {
+	return s.recipientStatus
+}
+
+func (s *handlerSession) Reset() {
+	s.envelope = Envelope{}
+	s.recipientStatus = nil
+}
+
+func (s *handlerSession) Logout() error {
+	return nil
+}
+
+func (s *handlerSession) lmtpDeliver() []error {
+	if s.srv.LMTPHandler != nil {
+		return s.srv.LMTPHandler(s.peer, s.envelope)
+	}
+	return make([]error, len(s.envelope.Recipients))
+}
+
+// backend returns the Backend in effect for this server: srv.Backend if
+// set, otherwise a handlerBackend shim wrapping Handler/LMTPHandler.
+func (srv *Server) backend() Backend {
+	if srv.Backend != nil {
+		return srv.Backend
+	}
+	return &handlerBackend{srv: srv}
+}
@@ -0,0 +1,364 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// handle parses one command line and dispatches it to the matching verb
+// handler. It is called once per line read by session.serve()'s scanner
+// loop, for every command except the continuation lines of AUTH and DATA,
+// which are read directly off session.scanner by auth() and
+// handleDataCommand() respectively.
+func (session *session) handle(line string) {
+
+	verb, args := parseCommand(line)
+
+	switch verb {
+	case "HELO", "EHLO", lhloVerb:
+		session.handleGreeting(verb, args)
+	case "MAIL":
+		session.handleMail(args)
+	case "RCPT":
+		session.handleRcpt(args)
+	case "DATA":
+		session.handleDataCommand()
+	case "AUTH":
+		session.handleAuthCommand(args)
+	case "STARTTLS":
+		session.handleStartTLS()
+	case "RSET":
+		session.handleReset()
+	case "NOOP":
+		session.reply(250, "2.0.0 Ok")
+	case "QUIT":
+		session.reply(221, "2.0.0 Bye")
+		session.quit = true
+	default:
+		session.reply(500, "5.5.1 Unrecognized command")
+	}
+
+}
+
+// parseCommand splits a command line into its verb (upper-cased) and the
+// rest of the line.
+func parseCommand(line string) (verb, args string) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	verb = strings.ToUpper(fields[0])
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return
+}
+
+// handleGreeting processes HELO/EHLO/LHLO: it validates the verb against
+// the server's protocol mode, runs HeloChecker, opens the backend Session,
+// and replies with the extension list for EHLO/LHLO or a plain greeting for
+// HELO.
+func (session *session) handleGreeting(verb, args string) {
+
+	if !session.server.checkGreeting(verb) {
+		if session.server.LMTP {
+			session.reply(500, "5.5.1 Expected LHLO")
+		} else {
+			session.reply(500, "5.5.1 Expected HELO/EHLO")
+		}
+		return
+	}
+
+	session.peer.HeloName = args
+
+	if session.server.HeloChecker != nil {
+		if err := session.server.HeloChecker(session.peer); err != nil {
+			session.error(err)
+			return
+		}
+	}
+
+	if err := session.startBackendSession(); err != nil {
+		session.error(err)
+		return
+	}
+
+	if verb == "HELO" {
+		session.reply(250, session.server.WelcomeMessage)
+		return
+	}
+
+	session.replyMultiline(250, append([]string{session.server.WelcomeMessage}, session.extensions()...))
+
+}
+
+// handleMail processes MAIL FROM, parsing the address and any ESMTP
+// parameters before handing off to session.mail.
+func (session *session) handleMail(args string) {
+
+	if session.backendSession == nil {
+		session.reply(503, "5.5.1 Send HELO/EHLO first")
+		return
+	}
+
+	addr, params, err := parseMailRcptArg("FROM:", args)
+	if err != nil {
+		session.error(err)
+		return
+	}
+
+	opts, err := parseMailOptions(params)
+	if err != nil {
+		session.error(err)
+		return
+	}
+
+	if opts.Size > 0 && opts.Size > session.server.MaxMessageSize {
+		session.reply(552, "5.3.4 Message too big")
+		return
+	}
+
+	if session.server.SenderChecker != nil {
+		if err := session.server.SenderChecker(session.peer, addr); err != nil {
+			session.error(err)
+			return
+		}
+	}
+
+	// MAIL FROM starts a new mail transaction (RFC 5321 4.1.1.2): reset the
+	// recipient count and the backend Session's own state, same as RSET,
+	// so a message sent without an intervening RSET doesn't inherit
+	// recipients or MaxRecipients accounting from the prior one.
+	session.backendSession.Reset()
+	session.recipientCount = 0
+
+	if err := session.mail(addr, opts); err != nil {
+		session.error(err)
+		return
+	}
+
+	session.reply(250, "2.1.0 Ok")
+
+}
+
+// handleRcpt processes RCPT TO, parsing the address before handing off to
+// session.rcpt.
+func (session *session) handleRcpt(args string) {
+
+	if session.backendSession == nil {
+		session.reply(503, "5.5.1 Send HELO/EHLO first")
+		return
+	}
+
+	addr, _, err := parseMailRcptArg("TO:", args)
+	if err != nil {
+		session.error(err)
+		return
+	}
+
+	if session.server.RecipientChecker != nil {
+		if err := session.server.RecipientChecker(session.peer, addr); err != nil {
+			session.error(err)
+			return
+		}
+	}
+
+	if err := session.rcpt(addr); err != nil {
+		session.error(err)
+		return
+	}
+
+	session.reply(250, "2.1.5 Ok")
+
+}
+
+// handleDataCommand processes DATA: it replies 354, reads the dot-stuffed
+// body directly off session.scanner until the terminating ".", and streams
+// it through an io.Pipe into session.finishData so the Session sees the
+// message as it arrives instead of after it's fully buffered.
+func (session *session) handleDataCommand() {
+
+	if session.recipientCount == 0 {
+		session.reply(503, "5.5.1 RCPT TO required before DATA")
+		return
+	}
+
+	session.reply(354, "Go ahead")
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		session.finishData(pr)
+		pr.Close()
+		close(done)
+	}()
+
+	pipeOpen := true
+
+	for session.scanner.Scan() {
+		line := session.scanner.Text()
+		if line == "." {
+			break
+		}
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+		// Once the backend has stopped reading (e.g. it already rejected
+		// the message as too big), keep scanning to discard the rest of
+		// the body instead of leaving it to be misread as the next
+		// command once we return to session.serve()'s loop.
+		if pipeOpen {
+			if _, err := pw.Write([]byte(line + "\r\n")); err != nil {
+				pipeOpen = false
+			}
+		}
+	}
+
+	pw.Close()
+	<-done
+
+}
+
+// handleAuthCommand processes AUTH: it parses the mechanism name and any
+// initial response, then hands off to session.auth.
+func (session *session) handleAuthCommand(args string) {
+
+	fields := strings.SplitN(args, " ", 2)
+	if fields[0] == "" {
+		session.reply(501, "5.5.4 Syntax: AUTH mechanism")
+		return
+	}
+
+	mech := strings.ToUpper(fields[0])
+	var initialResponse string
+	if len(fields) == 2 {
+		initialResponse = fields[1]
+	}
+
+	if err := session.auth(mech, initialResponse); err != nil {
+		session.error(err)
+		return
+	}
+
+	session.reply(235, "2.7.0 Authentication successful")
+
+}
+
+// handleStartTLS processes STARTTLS: it upgrades the connection, re-wires
+// the session's I/O around the TLS conn, and discards any prior greeting
+// and transaction state, since RFC 3207 requires the client to start over
+// with a fresh EHLO/LHLO.
+func (session *session) handleStartTLS() {
+
+	if session.server.TLSConfig == nil {
+		session.reply(502, "5.5.1 STARTTLS not supported")
+		return
+	}
+	if session.tls {
+		session.reply(503, "5.5.1 Already using TLS")
+		return
+	}
+
+	session.reply(220, "2.0.0 Go ahead")
+
+	conn := tls.Server(session.conn, session.server.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		session.server.logf("smtpd: session %d: STARTTLS handshake: %s", session.id, err)
+		session.close()
+		return
+	}
+
+	session.resetIO(conn)
+	session.tls = true
+
+	if session.backendSession != nil {
+		if err := session.backendSession.Logout(); err != nil {
+			session.server.logf("smtpd: session %d: Logout: %s", session.id, err)
+		}
+		session.backendSession = nil
+	}
+	session.peer.HeloName = ""
+	session.recipientCount = 0
+
+}
+
+// handleReset processes RSET: it resets the current mail transaction
+// without tearing down the backend Session itself.
+func (session *session) handleReset() {
+	if session.backendSession != nil {
+		session.backendSession.Reset()
+	}
+	session.recipientCount = 0
+	session.reply(250, "2.0.0 Ok")
+}
+
+// parseMailRcptArg extracts the address out of a "FROM:<addr> params" or
+// "TO:<addr> params" argument string, returning the remaining params
+// unparsed.
+func parseMailRcptArg(prefix, args string) (addr, params string, err error) {
+
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return "", "", Error{Code: 501, Message: "5.5.4 Syntax: " + prefix + "<address>"}
+	}
+
+	rest := strings.TrimSpace(args[len(prefix):])
+
+	if !strings.HasPrefix(rest, "<") {
+		return "", "", Error{Code: 501, Message: "5.5.4 Syntax: " + prefix + "<address>"}
+	}
+
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", "", Error{Code: 501, Message: "5.5.4 Syntax: " + prefix + "<address>"}
+	}
+
+	addr = rest[1:end]
+	params = strings.TrimSpace(rest[end+1:])
+
+	return addr, params, nil
+
+}
+
+// parseMailOptions parses the space-separated KEY=VALUE parameters that may
+// follow a MAIL FROM address into a MailOptions.
+func parseMailOptions(params string) (MailOptions, error) {
+
+	var opts MailOptions
+
+	for _, param := range strings.Fields(params) {
+
+		kv := strings.SplitN(param, "=", 2)
+		key := strings.ToUpper(kv[0])
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+
+		switch key {
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, Error{Code: 501, Message: "5.5.4 Invalid SIZE parameter"}
+			}
+			opts.Size = size
+		case "BODY":
+			opts.Body = strings.ToUpper(value)
+		case "SMTPUTF8":
+			opts.UTF8 = true
+		case "AUTH":
+			if value != "<>" {
+				opts.Auth = value
+			}
+		case "RET":
+			opts.Return = strings.ToUpper(value)
+		case "ENVID":
+			opts.EnvelopeID = value
+		default:
+			return opts, Error{Code: 504, Message: "5.5.4 Unrecognized parameter " + key}
+		}
+
+	}
+
+	return opts, nil
+
+}
@@ -0,0 +1,30 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// debugWriter copies every write it receives to out, one line at a time,
+// each prefixed with a connection id and a direction marker ("<--" for
+// data read from the client, "-->" for data written to it). It backs
+// Server.Debug.
+type debugWriter struct {
+	out    io.Writer
+	connID int64
+	dir    string
+}
+
+func (d *debugWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fmt.Fprintf(d.out, "[%d] %s %s", d.connID, d.dir, line)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			fmt.Fprintln(d.out)
+		}
+	}
+	return len(p), nil
+}
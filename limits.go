@@ -0,0 +1,31 @@
+package smtpd
+
+import "io"
+
+// ErrMessageTooBig is returned by the Reader passed to Session.Data once
+// more than Server.MaxMessageSize bytes have been read from it.
+var ErrMessageTooBig = Error{Code: 552, Message: "5.3.4 Message too big"}
+
+// maxSizeReader wraps r and fails with ErrMessageTooBig once more than max
+// bytes have been read, so a DATA body can't be streamed unboundedly into
+// memory or to a Backend.
+type maxSizeReader struct {
+	r io.Reader
+	n int64 // bytes remaining before ErrMessageTooBig
+}
+
+func newMaxSizeReader(r io.Reader, max int64) *maxSizeReader {
+	return &maxSizeReader{r: r, n: max}
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n <= 0 {
+		return 0, ErrMessageTooBig
+	}
+	if int64(len(p)) > m.n {
+		p = p[:m.n]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	return n, err
+}
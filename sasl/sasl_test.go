@@ -0,0 +1,111 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPlainServer(t *testing.T) {
+	var got struct{ identity, username, password string }
+
+	s := NewPlainServer(func(identity, username, password string) error {
+		got.identity, got.username, got.password = identity, username, password
+		return nil
+	})
+
+	challenge, done, err := s.Next([]byte("\x00alice\x00secret"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !done {
+		t.Fatal("expected PLAIN to finish in one step")
+	}
+	if challenge != nil {
+		t.Fatalf("expected no further challenge, got %q", challenge)
+	}
+	if got.username != "alice" || got.password != "secret" {
+		t.Fatalf("got username=%q password=%q", got.username, got.password)
+	}
+}
+
+func TestPlainServerRejectsMalformedResponse(t *testing.T) {
+	s := NewPlainServer(func(identity, username, password string) error { return nil })
+
+	if _, _, err := s.Next([]byte("no-nuls-here")); err == nil {
+		t.Fatal("expected an error for a response missing the NUL separators")
+	}
+}
+
+func TestLoginServer(t *testing.T) {
+	var got struct{ username, password string }
+
+	s := NewLoginServer(func(username, password string) error {
+		got.username, got.password = username, password
+		return nil
+	})
+
+	challenge, done, err := s.Next(nil)
+	if err != nil || done || string(challenge) != "Username:" {
+		t.Fatalf("step 1: challenge=%q done=%v err=%v", challenge, done, err)
+	}
+
+	challenge, done, err = s.Next([]byte("alice"))
+	if err != nil || done || string(challenge) != "Password:" {
+		t.Fatalf("step 2: challenge=%q done=%v err=%v", challenge, done, err)
+	}
+
+	_, done, err = s.Next([]byte("secret"))
+	if err != nil || !done {
+		t.Fatalf("step 3: done=%v err=%v", done, err)
+	}
+	if got.username != "alice" || got.password != "secret" {
+		t.Fatalf("got username=%q password=%q", got.username, got.password)
+	}
+}
+
+func TestCramMD5ServerChallengesAreUnique(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+		s := NewCramMD5Server("mail.example.com", func(username string, challenge, digest []byte) error {
+			return nil
+		})
+
+		challenge, done, err := s.Next(nil)
+		if err != nil || done {
+			t.Fatalf("iteration %d: challenge=%q done=%v err=%v", i, challenge, done, err)
+		}
+		if seen[string(challenge)] {
+			t.Fatalf("iteration %d: challenge %q was already issued", i, challenge)
+		}
+		seen[string(challenge)] = true
+	}
+}
+
+func TestCramMD5ServerVerifiesDigest(t *testing.T) {
+	const secret = "shared-secret"
+
+	var verified bool
+	s := NewCramMD5Server("mail.example.com", func(username string, challenge, digest []byte) error {
+		verified = VerifyCramMD5(challenge, []byte(secret), digest)
+		return nil
+	})
+
+	challenge, _, err := s.Next(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(challenge)
+	response := []byte("alice " + hex.EncodeToString(mac.Sum(nil)))
+
+	if _, done, err := s.Next(response); err != nil || !done {
+		t.Fatalf("done=%v err=%v", done, err)
+	}
+	if !verified {
+		t.Fatal("expected the digest to verify against the issued challenge")
+	}
+}
@@ -1,16 +1,29 @@
-// Package smtpd implements an SMTP server with support for STARTTLS, authentication (PLAIN/LOGIN) and optional restrictions on the different stages of the SMTP session.
+// Package smtpd implements an SMTP server with support for STARTTLS, authentication (PLAIN/LOGIN), LMTP (RFC 2033) and optional restrictions on the different stages of the SMTP session.
 package smtpd
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/DiegoAscanio/smtpd/sasl"
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after Close or
+// Shutdown has been called, analogous to net/http.ErrServerClosed.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
 // Server defines the parameters for running the SMTP server
 type Server struct {
 	Addr           string // Address to listen on when using ListenAndServe. (default: "127.0.0.1:10025")
@@ -21,12 +34,32 @@ type Server struct {
 
 	MaxMessageSize int // Max message size in bytes. (default: 10240000)
 	MaxConnections int // Max concurrent connections, use -1 to disable. (default: 100)
+	MaxRecipients  int // Max RCPT TO commands per message. (default: 100)
+	MaxLineLength  int // Max command/response line length in bytes, per RFC 5321 4.5.3.1.6. (default: 2000)
+
+	// LMTP enables Local Mail Transfer Protocol mode (RFC 2033) instead of SMTP.
+	// In this mode the greeting verb must be LHLO (HELO/EHLO are rejected), and
+	// ListenAndServe/Serve refuse to start on a TCP listener since LMTP is meant
+	// to be used over a trusted transport such as a Unix domain socket.
+	LMTP bool
 
 	// New e-mails are handed off to this function.
 	// Can be left empty for a NOOP server.
 	// If an error is returned, it will be reported in the SMTP session.
 	Handler func(peer Peer, env Envelope) error
 
+	// LMTPHandler is used instead of Handler when LMTP is true. Unlike Handler,
+	// it returns one error per recipient (in the order they were accepted by
+	// RCPT TO), so that the end-of-DATA response can report per-recipient
+	// delivery status as required by RFC 2033. A nil entry means that
+	// recipient's delivery succeeded.
+	LMTPHandler func(peer Peer, env Envelope) []error
+
+	// Backend, when set, takes precedence over Handler/LMTPHandler and
+	// streams MAIL/RCPT/DATA through a Session instead of buffering the
+	// whole message in an Envelope. See the Backend and Session types.
+	Backend Backend
+
 	// Enable various checks during the SMTP session.
 	// Can be left empty for no restrictions.
 	// If an error is returned, it will be reported in the SMTP session.
@@ -37,13 +70,156 @@ type Server struct {
 	RecipientChecker  func(peer Peer, addr string) error // Called after each RCPT TO.
 
 	// Enable PLAIN/LOGIN authentication, only available after STARTTLS.
-	// Can be left empty for no authentication support.
+	// Deprecated: use EnableAuth with sasl.NewPlainServer/sasl.NewLoginServer
+	// instead, which also allows registering other mechanisms such as
+	// CRAM-MD5. Left in place for backwards compatibility; ignored once
+	// EnableAuth has been called at least once.
 	Authenticator func(peer Peer, username, password string) error
 
+	// AllowInsecureAuth permits the AUTH command before STARTTLS has been
+	// negotiated. Off by default, since advertising AUTH on a plaintext
+	// connection lets credentials be sniffed; only enable it on trusted
+	// networks (e.g. a LAN-only LMTP deployment).
+	AllowInsecureAuth bool
+
+	authMechanisms map[string]func(*Conn) sasl.Server
+	authOrder      []string
+
 	TLSConfig *tls.Config // Enable STARTTLS support.
 	ForceTLS  bool        // Force STARTTLS usage.
+
+	// Debug, when set, receives a trace of every line read from and written
+	// to each session's connection, prefixed with a per-connection id and a
+	// direction marker, for protocol debugging.
+	Debug io.Writer
+
+	// ErrorLog, when set, receives internal errors (e.g. a failed STARTTLS
+	// handshake) that aren't part of the SMTP command/reply exchange and so
+	// can't be reported to the client with a status code. Left nil, these
+	// errors are silently discarded.
+	ErrorLog Logger
+
+	mu            sync.Mutex
+	listener      net.Listener
+	sessions      sync.Map // *session -> struct{}, live sessions being served
+	wg            sync.WaitGroup
+	inShutdown    int32 // atomic bool, set by Close/Shutdown
+	nextSessionID int64
+}
+
+// Logger is the interface used by Server.ErrorLog. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// logf reports an internal error to ErrorLog, if set.
+func (srv *Server) logf(format string, v ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, v...)
+	}
+}
+
+// Close immediately closes the listener and all live connections, and
+// causes Serve/ListenAndServe to return ErrServerClosed. It does not wait
+// for in-flight commands to finish; use Shutdown to drain gracefully.
+func (srv *Server) Close() error {
+
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.sessions.Range(func(key, _ interface{}) bool {
+		key.(*session).conn.Close()
+		return true
+	})
+
+	return err
+
 }
 
+// Shutdown closes the listener, replies 421 to any command received after
+// the call starts, and waits for in-flight sessions to finish (their
+// current command completes, then they quit) before returning. If ctx is
+// cancelled or its deadline passes first, any still-running sessions are
+// force-closed and Shutdown returns ctx.Err().
+func (srv *Server) Shutdown(ctx context.Context) error {
+
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		srv.sessions.Range(func(key, _ interface{}) bool {
+			key.(*session).conn.Close()
+			return true
+		})
+		return ctx.Err()
+	}
+
+}
+
+// isShuttingDown reports whether Close or Shutdown has been called.
+func (srv *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+func (srv *Server) trackSession(s *session) {
+	srv.sessions.Store(s, struct{}{})
+}
+
+func (srv *Server) untrackSession(s *session) {
+	srv.sessions.Delete(s)
+}
+
+// EnableAuth registers a SASL mechanism under mech (e.g. "PLAIN", "LOGIN",
+// "CRAM-MD5"). factory is called once per AUTH command to create a fresh
+// sasl.Server driving that exchange for the given connection. Mechanisms
+// are advertised in the EHLO/LHLO AUTH line in the order they were first
+// registered.
+func (srv *Server) EnableAuth(mech string, factory func(*Conn) sasl.Server) {
+	if srv.authMechanisms == nil {
+		srv.authMechanisms = make(map[string]func(*Conn) sasl.Server)
+	}
+	if _, exists := srv.authMechanisms[mech]; !exists {
+		srv.authOrder = append(srv.authOrder, mech)
+	}
+	srv.authMechanisms[mech] = factory
+}
+
+// Conn exposes per-connection state to SASL mechanism factories and other
+// pluggable hooks, without exposing the unexported session internals.
+type Conn struct {
+	session *session
+}
+
+// Peer returns the connecting client's identity as known when AUTH is
+// issued (i.e. after HELO/EHLO/LHLO, and possibly after STARTTLS).
+func (c *Conn) Peer() Peer { return c.session.peer }
+
+// TLS reports whether the connection is using STARTTLS.
+func (c *Conn) TLS() bool { return c.session.tls }
+
 // Peer represents the client connecting to the server
 type Peer struct {
 	HeloName string   // Server name used in HELO/EHLO command
@@ -71,8 +247,16 @@ func (e Error) Error() string { return fmt.Sprintf("%d %s", e.Code, e.Message) }
 type session struct {
 	server *Server
 
-	peer     Peer
-	envelope *Envelope
+	id int64 // per-server sequence number, used to prefix Debug output
+
+	peer Peer
+
+	// backendSession is set once HELO/EHLO/LHLO completes, via
+	// Server.backend().NewSession. The MAIL/RCPT/DATA commands are streamed
+	// through it; see Server.Backend and the handlerBackend shim in
+	// backend.go for the legacy Handler/Envelope path.
+	backendSession Session
+	recipientCount int
 
 	conn net.Conn
 
@@ -81,28 +265,89 @@ type session struct {
 	scanner *bufio.Scanner
 
 	tls bool
+
+	// quit is set by handle() on QUIT, so serve()'s read loop stops after
+	// replying instead of waiting for the client to close the connection.
+	quit bool
 }
 
 func (srv *Server) newSession(c net.Conn) (s *session) {
 
 	s = &session{
 		server: srv,
-		conn:   c,
-		reader: bufio.NewReader(c),
-		writer: bufio.NewWriter(c),
 		peer:   Peer{Addr: c.RemoteAddr()},
+		id:     atomic.AddInt64(&srv.nextSessionID, 1),
 	}
 
-	s.scanner = bufio.NewScanner(s.reader)
+	s.resetIO(c)
 
 	return
 
 }
 
+// resetIO (re)wires the session's reader/writer/scanner around conn,
+// re-applying the Debug trace and MaxLineLength split function. Used for the
+// initial connection, and again by handleStartTLS once the TLS handshake
+// replaces the underlying net.Conn.
+func (session *session) resetIO(c net.Conn) {
+
+	session.conn = c
+
+	var r io.Reader = c
+	var w io.Writer = c
+
+	if session.server.Debug != nil {
+		r = io.TeeReader(c, &debugWriter{out: session.server.Debug, connID: session.id, dir: "<--"})
+		w = io.MultiWriter(c, &debugWriter{out: session.server.Debug, connID: session.id, dir: "-->"})
+	}
+
+	session.reader = bufio.NewReader(r)
+	session.writer = bufio.NewWriter(w)
+	session.scanner = bufio.NewScanner(session.reader)
+	session.scanner.Buffer(make([]byte, 4096), session.server.MaxLineLength+1)
+	session.scanner.Split(maxLineSplit(session.server.MaxLineLength))
+
+}
+
+// errLineTooLong stops the line scanner when a client sends a command line
+// longer than Server.MaxLineLength, so session.serve() can reject it with
+// "500 Line too long" instead of growing an unbounded buffer.
+var errLineTooLong = errors.New("smtpd: line too long")
+
+// maxLineSplit is bufio.ScanLines with a maximum line length: it returns
+// errLineTooLong instead of returning an ever-growing token once data
+// (excluding the trailing newline) exceeds maxLen bytes.
+func maxLineSplit(maxLen int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			if i > maxLen {
+				return 0, nil, errLineTooLong
+			}
+			return i + 1, dropCR(data[0:i]), nil
+		}
+		if len(data) > maxLen {
+			return 0, nil, errLineTooLong
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), dropCR(data), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[0 : len(data)-1]
+	}
+	return data
+}
+
 // ListenAndServe starts the SMTP server and listens on the address provided in Server.Addr
 func (srv *Server) ListenAndServe() error {
 
-	srv.configureDefaults()
+	if err := srv.configureDefaults(); err != nil {
+		return err
+	}
 
 	l, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
@@ -115,10 +360,22 @@ func (srv *Server) ListenAndServe() error {
 // Serve starts the SMTP server and listens on the Listener provided
 func (srv *Server) Serve(l net.Listener) error {
 
-	srv.configureDefaults()
+	if err := srv.configureDefaults(); err != nil {
+		return err
+	}
 
 	defer l.Close()
 
+	if srv.LMTP {
+		if _, isTCP := l.Addr().(*net.TCPAddr); isTCP {
+			return fmt.Errorf("smtpd: LMTP requires a non-TCP listener (e.g. a Unix domain socket)")
+		}
+	}
+
+	srv.mu.Lock()
+	srv.listener = l
+	srv.mu.Unlock()
+
 	var limiter chan struct{}
 
 	if srv.MaxConnections > 0 {
@@ -131,7 +388,11 @@ func (srv *Server) Serve(l net.Listener) error {
 
 		conn, e := l.Accept()
 		if e != nil {
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+			if srv.isShuttingDown() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(e, &ne) && ne.Timeout() {
 				time.Sleep(time.Second)
 				continue
 			}
@@ -139,6 +400,8 @@ func (srv *Server) Serve(l net.Listener) error {
 		}
 
 		session := srv.newSession(conn)
+		srv.trackSession(session)
+		srv.wg.Add(1)
 
 		if limiter != nil {
 			go func() {
@@ -158,7 +421,7 @@ func (srv *Server) Serve(l net.Listener) error {
 
 }
 
-func (srv *Server) configureDefaults() {
+func (srv *Server) configureDefaults() error {
 
 	if srv.MaxMessageSize == 0 {
 		srv.MaxMessageSize = 10240000
@@ -168,6 +431,14 @@ func (srv *Server) configureDefaults() {
 		srv.MaxConnections = 100
 	}
 
+	if srv.MaxRecipients == 0 {
+		srv.MaxRecipients = 100
+	}
+
+	if srv.MaxLineLength == 0 {
+		srv.MaxLineLength = 2000
+	}
+
 	if srv.ReadTimeout == 0 {
 		srv.ReadTimeout = time.Second * 60
 	}
@@ -177,7 +448,7 @@ func (srv *Server) configureDefaults() {
 	}
 
 	if srv.ForceTLS && srv.TLSConfig == nil {
-		log.Fatal("Cannot use ForceTLS with no TLSConfig")
+		return fmt.Errorf("smtpd: cannot use ForceTLS with no TLSConfig")
 	}
 
 	if srv.Addr == "" {
@@ -189,13 +460,15 @@ func (srv *Server) configureDefaults() {
 		hostname, err := os.Hostname()
 
 		if err != nil {
-			log.Fatal("Couldn't determine hostname: %s", err)
+			return fmt.Errorf("smtpd: couldn't determine hostname: %w", err)
 		}
 
 		srv.WelcomeMessage = fmt.Sprintf("%s ESMTP ready.", hostname)
 
 	}
 
+	return nil
+
 }
 
 func (session *session) serve() {
@@ -205,7 +478,18 @@ func (session *session) serve() {
 	session.welcome()
 
 	for session.scanner.Scan() {
+		if session.server.isShuttingDown() {
+			session.reply(421, "4.3.2 Server shutting down")
+			return
+		}
 		session.handle(session.scanner.Text())
+		if session.quit {
+			return
+		}
+	}
+
+	if session.scanner.Err() == errLineTooLong {
+		session.reply(500, "Line too long")
 	}
 
 }
@@ -231,8 +515,27 @@ func (session *session) welcome() {
 }
 
 func (session *session) reply(code int, message string) {
-
 	fmt.Fprintf(session.writer, "%d %s\r\n", code, message)
+	session.flush()
+}
+
+// replyMultiline sends a multi-line reply (e.g. the EHLO/LHLO extension
+// list), using "-" to continue and " " on the final line, per RFC 5321
+// 4.2.1.
+func (session *session) replyMultiline(code int, lines []string) {
+	for i, line := range lines {
+		sep := byte('-')
+		if i == len(lines)-1 {
+			sep = ' '
+		}
+		fmt.Fprintf(session.writer, "%d%c%s\r\n", code, sep, line)
+	}
+	session.flush()
+}
+
+// flush writes the buffered reply and resets the read/write deadlines for
+// the next command.
+func (session *session) flush() {
 
 	session.conn.SetWriteDeadline(time.Now().Add(session.server.WriteTimeout))
 	session.writer.Flush()
@@ -260,23 +563,208 @@ func (session *session) extensions() []string {
 		extensions = append(extensions, "STARTTLS")
 	}
 
-	if session.server.Authenticator != nil && session.tls {
-		extensions = append(extensions, "AUTH PLAIN LOGIN")
+	if mechs := session.authMechanisms(); len(mechs) > 0 && (session.tls || session.server.AllowInsecureAuth) {
+		extensions = append(extensions, "AUTH "+strings.Join(mechs, " "))
 	}
 
 	return extensions
 
 }
 
-func (session *session) deliver() error {
-	if session.server.Handler != nil {
-		return session.server.Handler(session.peer, *session.envelope)
+// authMechanisms returns the SASL mechanisms advertised in AUTH: whatever
+// was registered via EnableAuth, or "PLAIN LOGIN" if only the legacy
+// Authenticator callback is set, for backwards compatibility.
+func (session *session) authMechanisms() []string {
+	if len(session.server.authOrder) > 0 {
+		return session.server.authOrder
+	}
+	if session.server.Authenticator != nil {
+		return []string{"PLAIN", "LOGIN"}
 	}
 	return nil
 }
 
+// auth drives the AUTH command: mech is the requested mechanism name and
+// initialResponse is the base64 blob following it on the same line, if any
+// (the "initial response" form, e.g. "AUTH PLAIN <base64>"), or "" if none
+// was given.
+func (session *session) auth(mech string, initialResponse string) error {
+
+	if !session.tls && !session.server.AllowInsecureAuth {
+		return Error{Code: 538, Message: "5.7.11 Encryption required for requested authentication mechanism"}
+	}
+
+	var server sasl.Server
+
+	if factory, ok := session.server.authMechanismFactory(mech); ok {
+		server = factory(&Conn{session: session})
+	} else if len(session.server.authOrder) == 0 && session.server.Authenticator != nil && (mech == "PLAIN" || mech == "LOGIN") {
+		authenticator := session.server.Authenticator
+		if mech == "PLAIN" {
+			server = sasl.NewPlainServer(func(identity, username, password string) error {
+				return authenticator(session.peer, username, password)
+			})
+		} else {
+			server = sasl.NewLoginServer(func(username, password string) error {
+				return authenticator(session.peer, username, password)
+			})
+		}
+	} else {
+		return Error{Code: 504, Message: "5.5.4 Unrecognized authentication type"}
+	}
+
+	var response []byte
+	haveInitial := initialResponse != ""
+
+	if haveInitial {
+		decoded, err := base64.StdEncoding.DecodeString(initialResponse)
+		if err != nil {
+			return Error{Code: 501, Message: "5.5.2 Invalid base64 data"}
+		}
+		response = decoded
+	}
+
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			return Error{Code: 535, Message: "5.7.8 Authentication failed"}
+		}
+		if done {
+			return nil
+		}
+
+		session.reply(334, base64.StdEncoding.EncodeToString(challenge))
+
+		if !session.scanner.Scan() {
+			return Error{Code: 501, Message: "5.5.4 Unexpected end of authentication exchange"}
+		}
+
+		line := session.scanner.Text()
+		if line == "*" {
+			return Error{Code: 501, Message: "5.0.0 Authentication cancelled"}
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return Error{Code: 501, Message: "5.5.2 Invalid base64 data"}
+		}
+		response = decoded
+	}
+
+}
+
+// authMechanismFactory looks up a mechanism registered via EnableAuth.
+func (srv *Server) authMechanismFactory(mech string) (func(*Conn) sasl.Server, bool) {
+	factory, ok := srv.authMechanisms[mech]
+	return factory, ok
+}
+
+// startBackendSession opens the streaming Session for this connection, once
+// the greeting (HELO/EHLO/LHLO) has completed and session.peer.HeloName is
+// known. It is a no-op if already started.
+func (session *session) startBackendSession() error {
+	if session.backendSession != nil {
+		return nil
+	}
+	s, err := session.server.backend().NewSession(session.peer)
+	if err != nil {
+		return err
+	}
+	session.backendSession = s
+	return nil
+}
+
+// mail handles MAIL FROM when a Session is in use, forwarding the sender
+// address and parsed ESMTP parameters.
+func (session *session) mail(from string, opts MailOptions) error {
+	return session.backendSession.Mail(from, opts)
+}
+
+// rcpt handles RCPT TO when a Session is in use, enforcing MaxRecipients.
+func (session *session) rcpt(to string) error {
+	if session.recipientCount >= session.server.MaxRecipients {
+		return Error{Code: 452, Message: "4.5.3 Too many recipients"}
+	}
+	if err := session.backendSession.Rcpt(to); err != nil {
+		return err
+	}
+	session.recipientCount++
+	return nil
+}
+
+// data handles DATA when a Session is in use, streaming the message body
+// directly to the backend instead of buffering it into envelope.Data. r is
+// capped at MaxMessageSize; reading past it yields ErrMessageTooBig.
+func (session *session) data(r io.Reader) error {
+	return session.backendSession.Data(newMaxSizeReader(r, int64(session.server.MaxMessageSize)))
+}
+
+// finishData is the end-of-DATA "." command handler for the Backend/Session
+// path: it streams r into the active Session, then replies to the client.
+// In LMTP mode, if the Session also implements LMTPSession, one status line
+// is sent per recipient as RFC 2033 requires; otherwise a single reply is
+// sent, same as plain SMTP.
+func (session *session) finishData(r io.Reader) {
+
+	err := session.data(r)
+
+	if session.server.LMTP {
+		if lmtp, ok := session.backendSession.(LMTPSession); ok {
+			status := lmtp.RecipientStatus()
+			if len(status) < session.recipientCount {
+				// Data failed before the Session ever got to record a
+				// per-recipient status (e.g. the maxSizeReader tripped
+				// ErrMessageTooBig while reading the body): report err to
+				// every recipient instead of sending no reply at all.
+				for i := 0; i < session.recipientCount; i++ {
+					session.error(err)
+				}
+				return
+			}
+			for _, rcptErr := range status {
+				if rcptErr != nil {
+					session.error(rcptErr)
+				} else {
+					session.reply(250, "2.0.0 Ok")
+				}
+			}
+			return
+		}
+	}
+
+	if err != nil {
+		session.error(err)
+		return
+	}
+
+	session.reply(250, "2.0.0 Ok: queued")
+
+}
+
+
+// lhloVerb is the greeting command expected in LMTP mode, replacing HELO/EHLO.
+const lhloVerb = "LHLO"
+
+// checkGreeting reports whether verb is a valid greeting command for this
+// server's protocol mode: LHLO only when LMTP is enabled, HELO/EHLO otherwise.
+func (srv *Server) checkGreeting(verb string) bool {
+	if srv.LMTP {
+		return verb == lhloVerb
+	}
+	return verb == "HELO" || verb == "EHLO"
+}
+
 func (session *session) close() {
+	if session.backendSession != nil {
+		if err := session.backendSession.Logout(); err != nil {
+			session.server.logf("smtpd: session %d: Logout: %s", session.id, err)
+		}
+	}
 	session.writer.Flush()
 	time.Sleep(200 * time.Millisecond)
-	session.conn.Close()
+	if err := session.conn.Close(); err != nil {
+		session.server.logf("smtpd: session %d: closing connection: %s", session.id, err)
+	}
+	session.server.untrackSession(session)
+	session.server.wg.Done()
 }
@@ -0,0 +1,587 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSession is a minimal Session used to drive session.rcpt/session.data
+// in tests without a real Backend.
+type fakeSession struct {
+	recipients []string
+}
+
+func (f *fakeSession) Mail(from string, opts MailOptions) error { return nil }
+func (f *fakeSession) Rcpt(to string) error {
+	f.recipients = append(f.recipients, to)
+	return nil
+}
+func (f *fakeSession) Data(r io.Reader) error {
+	_, err := io.ReadAll(r)
+	return err
+}
+func (f *fakeSession) Reset()        {}
+func (f *fakeSession) Logout() error { return nil }
+
+func newTestSession(srv *Server) *session {
+	srv.configureDefaults()
+	return &session{server: srv, backendSession: &fakeSession{}}
+}
+
+func TestRcptEnforcesMaxRecipients(t *testing.T) {
+	srv := &Server{MaxRecipients: 3}
+	s := newTestSession(srv)
+
+	for i := 0; i < 3; i++ {
+		if err := s.rcpt("user@example.com"); err != nil {
+			t.Fatalf("recipient %d: unexpected error: %v", i, err)
+		}
+	}
+
+	err := s.rcpt("one-too-many@example.com")
+	smtpdErr, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected Error, got %T (%v)", err, err)
+	}
+	if smtpdErr.Code != 452 {
+		t.Fatalf("expected 452, got %d", smtpdErr.Code)
+	}
+}
+
+func TestHandlerSessionMailStartsNewTransaction(t *testing.T) {
+	s := &handlerSession{srv: &Server{}}
+
+	if err := s.Mail("sender1@example.com", MailOptions{}); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("recipient1@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	// A second MAIL FROM with no RSET in between, per RFC 5321 4.1.1.2,
+	// starts a new transaction: it must not leave recipient1 on the
+	// envelope delivered for message 2.
+	if err := s.Mail("sender2@example.com", MailOptions{}); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := s.Rcpt("recipient2@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	if s.envelope.Sender != "sender2@example.com" {
+		t.Fatalf("expected sender2@example.com, got %q", s.envelope.Sender)
+	}
+	if want := []string{"recipient2@example.com"}; !equalStrings(s.envelope.Recipients, want) {
+		t.Fatalf("expected only %v, got %v (recipient1 leaked across transactions)", want, s.envelope.Recipients)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRcptEnforcesMaxRecipientsAtScale(t *testing.T) {
+	srv := &Server{MaxRecipients: 1000000}
+	s := newTestSession(srv)
+
+	for i := 0; i < 1000000; i++ {
+		if err := s.rcpt("user@example.com"); err != nil {
+			t.Fatalf("recipient %d: unexpected error: %v", i, err)
+		}
+	}
+
+	err := s.rcpt("one-too-many@example.com")
+	smtpdErr, ok := err.(Error)
+	if !ok || smtpdErr.Code != 452 {
+		t.Fatalf("expected 452 after 1M recipients, got %v", err)
+	}
+}
+
+func TestDataEnforcesMaxMessageSize(t *testing.T) {
+	srv := &Server{MaxMessageSize: 1024}
+	s := newTestSession(srv)
+
+	body := bytes.Repeat([]byte("a"), 100*1024*1024) // 100 MB, well past the 1024 byte cap
+
+	err := s.data(bytes.NewReader(body))
+	if err != ErrMessageTooBig {
+		t.Fatalf("expected ErrMessageTooBig, got %v", err)
+	}
+	if ErrMessageTooBig.Code != 552 {
+		t.Fatalf("expected 552, got %d", ErrMessageTooBig.Code)
+	}
+}
+
+func TestDataAcceptsMessageUnderLimit(t *testing.T) {
+	srv := &Server{MaxMessageSize: 1024}
+	s := newTestSession(srv)
+
+	body := []byte("a short message")
+	if err := s.data(bytes.NewReader(body)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxLineSplitRejectsOverlongLine(t *testing.T) {
+	const maxLen = 2000
+
+	line := strings.Repeat("x", 10*1024*1024) // 10 MB single line, no newline
+	scanner := bufio.NewScanner(strings.NewReader(line))
+	scanner.Buffer(make([]byte, 4096), maxLen+1)
+	scanner.Split(maxLineSplit(maxLen))
+
+	if scanner.Scan() {
+		t.Fatalf("expected Scan to fail on an overlong line, got token %q", scanner.Text())
+	}
+	if scanner.Err() != errLineTooLong {
+		t.Fatalf("expected errLineTooLong, got %v", scanner.Err())
+	}
+}
+
+func TestMaxLineSplitAcceptsLineUnderLimit(t *testing.T) {
+	const maxLen = 2000
+
+	scanner := bufio.NewScanner(strings.NewReader("MAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\n"))
+	scanner.Buffer(make([]byte, 4096), maxLen+1)
+	scanner.Split(maxLineSplit(maxLen))
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %v", len(lines), lines)
+	}
+}
+
+func TestShutdownWaitsForInFlightSessionThenReturns(t *testing.T) {
+	srv := &Server{}
+	srv.wg.Add(1) // simulates one session still being served
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before the in-flight session finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	srv.wg.Done()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return once the in-flight session finished")
+	}
+}
+
+func TestShutdownForceClosesOnContextDeadline(t *testing.T) {
+	srv := &Server{}
+	srv.wg.Add(1) // never Done() — simulates a session stuck past the deadline
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// startTestServer starts srv on a loopback TCP listener and returns its
+// address and a func to shut it down. Unlike the tests above, which drive
+// session methods directly, the tests below dial a real net.Conn and speak
+// the wire protocol end to end, so they exercise session.handle and prove
+// the package actually compiles and dispatches commands.
+func startTestServer(t *testing.T, srv *Server) (addr string, stop func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go srv.Serve(l)
+
+	return l.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+}
+
+// readReply reads one (possibly multi-line) SMTP reply off r and returns
+// its status code and the final line.
+func readReply(t *testing.T, r *bufio.Reader) (code int, line string) {
+	t.Helper()
+
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if len(l) >= 4 && l[3] == '-' {
+			continue // multi-line continuation, e.g. EHLO's extension list
+		}
+		code, err = strconv.Atoi(l[:3])
+		if err != nil {
+			t.Fatalf("malformed reply %q: %v", l, err)
+		}
+		return code, l
+	}
+}
+
+func TestIntegrationOverlongLineIsRejected(t *testing.T) {
+	srv := &Server{MaxLineLength: 2000}
+	addr, stop := startTestServer(t, srv)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if code, line := readReply(t, r); code != 220 {
+		t.Fatalf("expected 220 greeting, got %q", line)
+	}
+
+	overlong := strings.Repeat("A", 10*1024*1024) // 10 MB, well past MaxLineLength
+
+	// The server stops reading (and closes the connection) as soon as it
+	// sees the line is too long, well before this write completes, so send
+	// it in the background rather than blocking the test on a write that
+	// may itself fail with a broken pipe once the server hangs up.
+	go conn.Write([]byte("HELO " + overlong + "\r\n"))
+
+	if code, line := readReply(t, r); code != 500 {
+		t.Fatalf("expected 500 Line too long, got %q", line)
+	}
+}
+
+func TestIntegrationMailResetsRecipientCount(t *testing.T) {
+	srv := &Server{MaxRecipients: 50}
+	addr, stop := startTestServer(t, srv)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readReply(t, r) // 220 greeting
+
+	write := func(cmd string) {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("write %q: %v", cmd, err)
+		}
+	}
+
+	write("EHLO client.example.com")
+	readReply(t, r)
+
+	// Message 1: a full transaction with one recipient, no RSET afterwards.
+	write("MAIL FROM:<sender@example.com>")
+	readReply(t, r)
+	write("RCPT TO:<recipient1@example.com>")
+	readReply(t, r)
+	write("DATA")
+	readReply(t, r)
+	write("message one")
+	write(".")
+	readReply(t, r)
+
+	// Message 2: a new MAIL FROM with no intervening RSET and zero RCPT TO.
+	// recipientCount must reset to 0 here, so DATA is rejected rather than
+	// going through on message 1's stale recipient count.
+	write("MAIL FROM:<sender@example.com>")
+	if code, line := readReply(t, r); code != 250 {
+		t.Fatalf("expected 250 for second MAIL FROM, got %q", line)
+	}
+
+	write("DATA")
+	if code, line := readReply(t, r); code != 503 {
+		t.Fatalf("expected 503 RCPT TO required before DATA, got %q", line)
+	}
+}
+
+func TestIntegrationMaxRecipientsEnforced(t *testing.T) {
+	const maxRecipients = 50 // representative; session.rcpt's enforcement is already exercised at 1M scale above
+
+	srv := &Server{MaxRecipients: maxRecipients}
+	addr, stop := startTestServer(t, srv)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readReply(t, r) // 220 greeting
+
+	write := func(cmd string) {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("write %q: %v", cmd, err)
+		}
+	}
+
+	write("EHLO client.example.com")
+	if code, line := readReply(t, r); code != 250 {
+		t.Fatalf("expected 250 for EHLO, got %q", line)
+	}
+
+	write("MAIL FROM:<sender@example.com>")
+	if code, line := readReply(t, r); code != 250 {
+		t.Fatalf("expected 250 for MAIL FROM, got %q", line)
+	}
+
+	for i := 0; i < maxRecipients; i++ {
+		write(fmt.Sprintf("RCPT TO:<user%d@example.com>", i))
+		if code, line := readReply(t, r); code != 250 {
+			t.Fatalf("recipient %d: expected 250, got %q", i, line)
+		}
+	}
+
+	write("RCPT TO:<one-too-many@example.com>")
+	if code, line := readReply(t, r); code != 452 {
+		t.Fatalf("expected 452 past MaxRecipients, got %q", line)
+	}
+}
+
+// startTestLMTPServer starts srv, with LMTP forced on, on a Unix domain
+// socket and returns a dialer for it and a func to shut it down. LMTP
+// refuses to run on a TCP listener (see Server.Serve), so these tests need
+// their own helper rather than startTestServer above.
+func startTestLMTPServer(t *testing.T, srv *Server) (dial func() (net.Conn, error), stop func()) {
+	t.Helper()
+
+	srv.LMTP = true
+
+	sockPath := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go srv.Serve(l)
+
+	return func() (net.Conn, error) {
+			return net.Dial("unix", sockPath)
+		}, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}
+}
+
+func TestServeClosesListenerWhenLMTPOverTCPIsRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	srv := &Server{LMTP: true}
+	if err := srv.Serve(l); err == nil {
+		t.Fatal("expected an error rejecting LMTP over a TCP listener")
+	}
+
+	// Serve must close l itself on this path rather than leaking it: a
+	// second Listen on the now-freed address should succeed.
+	l2, err := net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("listener was not closed by Serve: %v", err)
+	}
+	l2.Close()
+}
+
+func TestIntegrationLMTPRepliesOncePerRecipient(t *testing.T) {
+	srv := &Server{}
+	dial, stop := startTestLMTPServer(t, srv)
+	defer stop()
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readReply(t, r) // 220 greeting
+
+	write := func(cmd string) {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("write %q: %v", cmd, err)
+		}
+	}
+
+	write("LHLO client.example.com")
+	if code, line := readReply(t, r); code != 250 {
+		t.Fatalf("expected 250 for LHLO, got %q", line)
+	}
+
+	write("MAIL FROM:<sender@example.com>")
+	if code, line := readReply(t, r); code != 250 {
+		t.Fatalf("expected 250 for MAIL FROM, got %q", line)
+	}
+
+	const recipients = 3
+	for i := 0; i < recipients; i++ {
+		write(fmt.Sprintf("RCPT TO:<user%d@example.com>", i))
+		if code, line := readReply(t, r); code != 250 {
+			t.Fatalf("recipient %d: expected 250, got %q", i, line)
+		}
+	}
+
+	write("DATA")
+	if code, line := readReply(t, r); code != 354 {
+		t.Fatalf("expected 354 Go ahead, got %q", line)
+	}
+
+	write("this is the message body")
+	write(".")
+
+	for i := 0; i < recipients; i++ {
+		if code, line := readReply(t, r); code != 250 {
+			t.Fatalf("end-of-DATA reply %d: expected 250, got %q", i, line)
+		}
+	}
+}
+
+func TestIntegrationLMTPOversizedMessageRepliesToEveryRecipient(t *testing.T) {
+	srv := &Server{MaxMessageSize: 1024}
+	dial, stop := startTestLMTPServer(t, srv)
+	defer stop()
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readReply(t, r) // 220 greeting
+
+	write := func(cmd string) {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("write %q: %v", cmd, err)
+		}
+	}
+
+	write("LHLO client.example.com")
+	readReply(t, r)
+	write("MAIL FROM:<sender@example.com>")
+	readReply(t, r)
+
+	const recipients = 2
+	for i := 0; i < recipients; i++ {
+		write(fmt.Sprintf("RCPT TO:<user%d@example.com>", i))
+		readReply(t, r)
+	}
+
+	write("DATA")
+	if code, line := readReply(t, r); code != 354 {
+		t.Fatalf("expected 354 Go ahead, got %q", line)
+	}
+
+	// Many ordinary-length lines, well past the 1024 byte MaxMessageSize cap
+	// in total, so the maxSizeReader trips ErrMessageTooBig before
+	// lmtpDeliver (and therefore RecipientStatus) ever runs.
+	var body strings.Builder
+	for i := 0; i < 2000; i++ {
+		body.WriteString(strings.Repeat("a", 1000))
+		body.WriteString("\r\n")
+	}
+	body.WriteString(".\r\n")
+
+	if _, err := conn.Write([]byte(body.String())); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+
+	// Every accepted recipient must get a reply, not just the zero value
+	// of an unpopulated RecipientStatus.
+	for i := 0; i < recipients; i++ {
+		if code, line := readReply(t, r); code != 552 {
+			t.Fatalf("end-of-DATA reply %d: expected 552 Message too big, got %q", i, line)
+		}
+	}
+}
+
+func TestIntegrationMaxMessageSizeEnforced(t *testing.T) {
+	srv := &Server{MaxMessageSize: 1024}
+	addr, stop := startTestServer(t, srv)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readReply(t, r) // 220 greeting
+
+	write := func(cmd string) {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("write %q: %v", cmd, err)
+		}
+	}
+
+	write("HELO client.example.com")
+	readReply(t, r)
+	write("MAIL FROM:<sender@example.com>")
+	readReply(t, r)
+	write("RCPT TO:<recipient@example.com>")
+	readReply(t, r)
+
+	write("DATA")
+	if code, line := readReply(t, r); code != 354 {
+		t.Fatalf("expected 354 Go ahead, got %q", line)
+	}
+
+	// Many ordinary-length lines, well past the 1024 byte MaxMessageSize cap
+	// in total, so this exercises the size limit rather than the line-length
+	// limit covered by TestIntegrationOverlongLineIsRejected above.
+	var body strings.Builder
+	for i := 0; i < 2000; i++ {
+		body.WriteString(strings.Repeat("a", 1000))
+		body.WriteString("\r\n")
+	}
+	body.WriteString(".\r\n")
+
+	if _, err := conn.Write([]byte(body.String())); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+
+	if code, line := readReply(t, r); code != 552 {
+		t.Fatalf("expected 552 Message too big, got %q", line)
+	}
+}